@@ -0,0 +1,303 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package api provides a minimal client for the Circonus HTTP API used by
+// the higher level checkmgr and circonus-gometrics packages.
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultAPIURL = "https://api.circonus.com/v2"
+	defaultAPIApp = "circonus-gometrics"
+
+	// defaultMaxRetries bounds how many times a 429 or 5xx response is
+	// retried before the error is surfaced to the caller.
+	defaultMaxRetries = 4
+	// defaultMinRetryWait is the base of the exponential backoff used
+	// between retries, absent a server-supplied Retry-After.
+	defaultMinRetryWait = 1 * time.Second
+	// defaultMaxRetryWait caps the backoff so a misbehaving server can't
+	// stall a caller indefinitely.
+	defaultMaxRetryWait = 30 * time.Second
+)
+
+// TokenKeyHeader is the HTTP header used to pass the API token.
+const TokenKeyHeader = "X-Circonus-Auth-Token"
+
+// TokenAppHeader is the HTTP header used to pass the API application name.
+const TokenAppHeader = "X-Circonus-App-Name"
+
+// Config encapsulates the settings needed to instantiate an API client.
+type Config struct {
+	TokenApp  string
+	TokenKey  string
+	URL       string
+	TLSConfig *tls.Config
+	Log       *log.Logger
+	Debug     bool
+
+	// MaxRetries bounds how many times a 429 or 5xx API response is
+	// retried. Zero uses defaultMaxRetries.
+	MaxRetries int
+	// MinRetryWait is the base of the exponential backoff applied between
+	// retries when the server doesn't supply a Retry-After. Zero uses
+	// defaultMinRetryWait.
+	MinRetryWait time.Duration
+	// MaxRetryWait caps the backoff between retries. Zero uses
+	// defaultMaxRetryWait.
+	MaxRetryWait time.Duration
+}
+
+// API is a Circonus API client.
+type API struct {
+	apiURL *url.URL
+	key    string
+	app    string
+	client *http.Client
+	Debug  bool
+	Log    *log.Logger
+
+	maxRetries   int
+	minRetryWait time.Duration
+	maxRetryWait time.Duration
+}
+
+// NewAPI returns a configured Circonus API client.
+func NewAPI(cfg *Config) (*API, error) {
+	if cfg == nil {
+		return nil, fmt.Errorf("invalid API configuration (nil)")
+	}
+
+	if cfg.TokenKey == "" {
+		return nil, fmt.Errorf("API token is required")
+	}
+
+	au := cfg.URL
+	if au == "" {
+		au = defaultAPIURL
+	}
+	if !strings.HasSuffix(au, "/") {
+		au += "/"
+	}
+
+	u, err := url.Parse(au)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse API URL: %v", err)
+	}
+
+	app := cfg.TokenApp
+	if app == "" {
+		app = defaultAPIApp
+	}
+
+	a := &API{
+		apiURL:       u,
+		key:          cfg.TokenKey,
+		app:          app,
+		client:       &http.Client{},
+		Debug:        cfg.Debug,
+		Log:          cfg.Log,
+		maxRetries:   cfg.MaxRetries,
+		minRetryWait: cfg.MinRetryWait,
+		maxRetryWait: cfg.MaxRetryWait,
+	}
+
+	if a.Log == nil {
+		a.Log = log.New(os.Stderr, "", log.LstdFlags)
+	}
+
+	if a.maxRetries == 0 {
+		a.maxRetries = defaultMaxRetries
+	}
+	if a.minRetryWait == 0 {
+		a.minRetryWait = defaultMinRetryWait
+	}
+	if a.maxRetryWait == 0 {
+		a.maxRetryWait = defaultMaxRetryWait
+	}
+
+	if cfg.TLSConfig != nil {
+		a.client.Transport = &http.Transport{TLSClientConfig: cfg.TLSConfig}
+	}
+
+	return a, nil
+}
+
+func (a *API) apiCall(ctx context.Context, method, reqPath string, data []byte) ([]byte, error) {
+	reqURL := reqPath
+	if !strings.HasPrefix(reqURL, "http://") && !strings.HasPrefix(reqURL, "https://") {
+		path, query := reqPath, ""
+		if idx := strings.Index(reqPath, "?"); idx >= 0 {
+			path, query = reqPath[:idx], reqPath[idx+1:]
+		}
+
+		u := *a.apiURL
+		u.Path = u.Path + strings.TrimPrefix(path, "/")
+		u.RawQuery = query
+		reqURL = u.String()
+	}
+
+	var lastErr error
+
+	for attempt := 0; ; attempt++ {
+		var body *bytes.Buffer
+		if data != nil {
+			body = bytes.NewBuffer(data)
+		} else {
+			body = bytes.NewBuffer(nil)
+		}
+
+		req, err := http.NewRequest(method, reqURL, body)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create API request: %v", err)
+		}
+		req = req.WithContext(ctx)
+
+		req.Header.Add(TokenKeyHeader, a.key)
+		req.Header.Add(TokenAppHeader, a.app)
+		req.Header.Add("Accept", "application/json")
+		req.Header.Add("Content-Type", "application/json")
+
+		if a.Debug {
+			a.Log.Printf("[DEBUG] API %s %s", method, reqURL)
+		}
+
+		resp, err := a.client.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("error during API call: %v", err)
+		}
+
+		respBody, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error reading API response: %v", err)
+		}
+
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			return respBody, nil
+		}
+
+		lastErr = fmt.Errorf("API call %s %s returned %d: %s", method, reqURL, resp.StatusCode, string(respBody))
+
+		retryable := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+		if !retryable || attempt >= a.maxRetries {
+			return nil, lastErr
+		}
+
+		wait := retryAfter(resp.Header)
+		if wait == 0 {
+			wait = backoff(attempt, a.minRetryWait, a.maxRetryWait)
+		}
+
+		a.Log.Printf("[DEBUG] API %s %s returned %d, retrying in %v (attempt %d/%d)", method, reqURL, resp.StatusCode, wait, attempt+1, a.maxRetries)
+
+		if !sleep(ctx, wait) {
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// retryAfter returns the backoff a 429 response asked for via its
+// Retry-After header, or zero if the header is absent or not a plain
+// second count.
+func retryAfter(h http.Header) time.Duration {
+	v := h.Get("Retry-After")
+	if v == "" {
+		return 0
+	}
+	secs, err := strconv.Atoi(v)
+	if err != nil || secs < 0 {
+		return 0
+	}
+	return time.Duration(secs) * time.Second
+}
+
+// backoff returns an exponentially increasing, jittered wait for the given
+// retry attempt (0-indexed), capped at max.
+func backoff(attempt int, min, max time.Duration) time.Duration {
+	d := min << uint(attempt)
+	if d <= 0 || d > max {
+		d = max
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d)/2+1))
+}
+
+// sleep waits for d, returning false if ctx is done first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Get performs an HTTP GET against the API.
+func (a *API) Get(reqPath string) ([]byte, error) {
+	return a.apiCall(context.Background(), "GET", reqPath, nil)
+}
+
+// GetContext performs an HTTP GET against the API, aborting if ctx is done
+// before the call completes.
+func (a *API) GetContext(ctx context.Context, reqPath string) ([]byte, error) {
+	return a.apiCall(ctx, "GET", reqPath, nil)
+}
+
+// Post performs an HTTP POST against the API.
+func (a *API) Post(reqPath string, data []byte) ([]byte, error) {
+	return a.apiCall(context.Background(), "POST", reqPath, data)
+}
+
+// PostContext performs an HTTP POST against the API, aborting if ctx is done
+// before the call completes.
+func (a *API) PostContext(ctx context.Context, reqPath string, data []byte) ([]byte, error) {
+	return a.apiCall(ctx, "POST", reqPath, data)
+}
+
+// Put performs an HTTP PUT against the API.
+func (a *API) Put(reqPath string, data []byte) ([]byte, error) {
+	return a.apiCall(context.Background(), "PUT", reqPath, data)
+}
+
+// PutContext performs an HTTP PUT against the API, aborting if ctx is done
+// before the call completes.
+func (a *API) PutContext(ctx context.Context, reqPath string, data []byte) ([]byte, error) {
+	return a.apiCall(ctx, "PUT", reqPath, data)
+}
+
+// Delete performs an HTTP DELETE against the API.
+func (a *API) Delete(reqPath string) ([]byte, error) {
+	return a.apiCall(context.Background(), "DELETE", reqPath, nil)
+}
+
+// DeleteContext performs an HTTP DELETE against the API, aborting if ctx is
+// done before the call completes.
+func (a *API) DeleteContext(ctx context.Context, reqPath string) ([]byte, error) {
+	return a.apiCall(ctx, "DELETE", reqPath, nil)
+}
+
+func decode(raw []byte, v interface{}) error {
+	if err := json.Unmarshal(raw, v); err != nil {
+		return fmt.Errorf("unable to decode API response: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import "context"
+
+// BrokerDetail carries the per-instance connection information for a broker.
+type BrokerDetail struct {
+	CN           string   `json:"cn"`
+	ExternalHost string   `json:"external_host"`
+	ExternalPort int      `json:"external_port"`
+	IP           string   `json:"ipaddress"`
+	Modules      []string `json:"modules"`
+	Port         int      `json:"port"`
+	Status       string   `json:"status"`
+}
+
+// Broker defines a broker (formerly "agent"). See
+// https://login.circonus.com/resources/api/calls/broker
+type Broker struct {
+	CID     string         `json:"_cid,omitempty"`
+	Name    string         `json:"_name,omitempty"`
+	Type    string         `json:"_type,omitempty"`
+	Details []BrokerDetail `json:"_details,omitempty"`
+}
+
+// FetchBrokerByCID retrieves a broker by its CID.
+func (a *API) FetchBrokerByCID(cid string) (*Broker, error) {
+	return a.FetchBrokerByCIDContext(context.Background(), cid)
+}
+
+// FetchBrokerByCIDContext retrieves a broker by its CID, aborting if ctx is
+// done before the call completes.
+func (a *API) FetchBrokerByCIDContext(ctx context.Context, cid string) (*Broker, error) {
+	raw, err := a.GetContext(ctx, cid)
+	if err != nil {
+		return nil, err
+	}
+
+	broker := new(Broker)
+	if err := decode(raw, broker); err != nil {
+		return nil, err
+	}
+
+	return broker, nil
+}
+
+// FetchBrokers retrieves all brokers visible to the API token.
+func (a *API) FetchBrokers() ([]Broker, error) {
+	return a.FetchBrokersContext(context.Background())
+}
+
+// FetchBrokersContext retrieves all brokers visible to the API token,
+// aborting if ctx is done before the call completes.
+func (a *API) FetchBrokersContext(ctx context.Context) ([]Broker, error) {
+	raw, err := a.GetContext(ctx, "/broker")
+	if err != nil {
+		return nil, err
+	}
+
+	var brokers []Broker
+	if err := decode(raw, &brokers); err != nil {
+		return nil, err
+	}
+
+	return brokers, nil
+}
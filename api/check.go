@@ -0,0 +1,61 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"context"
+	"fmt"
+)
+
+// CheckDetails holds the broker-specific details of a check.
+type CheckDetails struct {
+	SubmissionURL string `json:"submission_url,omitempty"`
+}
+
+// Check defines a check. See https://login.circonus.com/resources/api/calls/check
+type Check struct {
+	CID            string       `json:"_cid,omitempty"`
+	Active         bool         `json:"_active,omitempty"`
+	BrokerCID      string       `json:"_broker,omitempty"`
+	CheckBundleCID string       `json:"_check_bundle,omitempty"`
+	CheckUUID      string       `json:"_check_uuid,omitempty"`
+	Details        CheckDetails `json:"_details,omitempty"`
+}
+
+// FetchCheckByID retrieves a check by its numeric id.
+func (a *API) FetchCheckByID(id int) (*Check, error) {
+	return a.FetchCheckByIDContext(context.Background(), id)
+}
+
+// FetchCheckByIDContext retrieves a check by its numeric id, aborting if ctx
+// is done before the call completes.
+func (a *API) FetchCheckByIDContext(ctx context.Context, id int) (*Check, error) {
+	raw, err := a.GetContext(ctx, fmt.Sprintf("/check/%d", id))
+	if err != nil {
+		return nil, err
+	}
+
+	check := new(Check)
+	if err := decode(raw, check); err != nil {
+		return nil, err
+	}
+
+	return check, nil
+}
+
+// FetchChecks retrieves all checks visible to the API token.
+func (a *API) FetchChecks() ([]Check, error) {
+	raw, err := a.Get("/check")
+	if err != nil {
+		return nil, err
+	}
+
+	var checks []Check
+	if err := decode(raw, &checks); err != nil {
+		return nil, err
+	}
+
+	return checks, nil
+}
@@ -0,0 +1,152 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+)
+
+// CheckBundleConfig holds the check-type specific configuration for a bundle.
+type CheckBundleConfig struct {
+	SubmissionURL string `json:"submission_url,omitempty"`
+	ReverseSecret string `json:"reverse:secret_key,omitempty"`
+}
+
+// CheckBundleMetric defines a single metric carried by a check bundle.
+type CheckBundleMetric struct {
+	Name   string   `json:"name"`
+	Type   string   `json:"type"`
+	Status string   `json:"status"`
+	Units  string   `json:"units,omitempty"`
+	Tags   []string `json:"tags,omitempty"`
+
+	// HistogramLayout carries the bucket boundaries for a Type "histogram"
+	// metric. It is opaque to the API itself; checkmgr uses it to detect
+	// when a histogram's bucket layout has changed and needs re-issuing.
+	HistogramLayout string `json:"histogram_layout,omitempty"`
+}
+
+// CheckBundle defines a check bundle. See
+// https://login.circonus.com/resources/api/calls/check_bundle
+type CheckBundle struct {
+	CheckUUIDs         []string            `json:"_check_uuids,omitempty"`
+	Checks             []string            `json:"_checks,omitempty"`
+	CID                string              `json:"_cid,omitempty"`
+	Created            int                 `json:"_created,omitempty"`
+	LastModified       int                 `json:"_last_modified,omitempty"`
+	LastModifedBy      string              `json:"_last_modifed_by,omitempty"`
+	ReverseConnectURLs []string            `json:"_reverse_connection_urls,omitempty"`
+	Brokers            []string            `json:"brokers"`
+	Config             CheckBundleConfig   `json:"config"`
+	DisplayName        string              `json:"display_name"`
+	Metrics            []CheckBundleMetric `json:"metrics"`
+	MetricLimit        int                 `json:"metric_limit,omitempty"`
+	Notes              string              `json:"notes,omitempty"`
+	Period             int                 `json:"period,omitempty"`
+	Status             string              `json:"status,omitempty"`
+	Target             string              `json:"target"`
+	Timeout            int                 `json:"timeout,omitempty"`
+	Type               string              `json:"type"`
+	Tags               []string            `json:"tags,omitempty"`
+}
+
+// FetchCheckBundleByCID retrieves a check bundle by its CID.
+func (a *API) FetchCheckBundleByCID(cid string) (*CheckBundle, error) {
+	return a.FetchCheckBundleByCIDContext(context.Background(), cid)
+}
+
+// FetchCheckBundleByCIDContext retrieves a check bundle by its CID, aborting
+// if ctx is done before the call completes.
+func (a *API) FetchCheckBundleByCIDContext(ctx context.Context, cid string) (*CheckBundle, error) {
+	raw, err := a.GetContext(ctx, cid)
+	if err != nil {
+		return nil, err
+	}
+
+	bundle := new(CheckBundle)
+	if err := decode(raw, bundle); err != nil {
+		return nil, err
+	}
+
+	return bundle, nil
+}
+
+// SearchCheckBundles returns the check bundles matching the given search tag(s).
+func (a *API) SearchCheckBundles(searchCriteria string) ([]CheckBundle, error) {
+	return a.SearchCheckBundlesContext(context.Background(), searchCriteria)
+}
+
+// SearchCheckBundlesContext returns the check bundles matching the given
+// search tag(s), aborting if ctx is done before the call completes.
+func (a *API) SearchCheckBundlesContext(ctx context.Context, searchCriteria string) ([]CheckBundle, error) {
+	query := fmt.Sprintf("/check_bundle?search=%s", url.QueryEscape(searchCriteria))
+
+	raw, err := a.GetContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	var bundles []CheckBundle
+	if err := decode(raw, &bundles); err != nil {
+		return nil, err
+	}
+
+	return bundles, nil
+}
+
+// NewCheckBundle creates a new check bundle.
+func (a *API) NewCheckBundle(bundle *CheckBundle) (*CheckBundle, error) {
+	return a.NewCheckBundleContext(context.Background(), bundle)
+}
+
+// NewCheckBundleContext creates a new check bundle, aborting if ctx is done
+// before the call completes.
+func (a *API) NewCheckBundleContext(ctx context.Context, bundle *CheckBundle) (*CheckBundle, error) {
+	data, err := json.Marshal(bundle)
+	if err != nil {
+		return nil, fmt.Errorf("unable to encode check bundle: %v", err)
+	}
+
+	raw, err := a.PostContext(ctx, "/check_bundle", data)
+	if err != nil {
+		return nil, err
+	}
+
+	newBundle := new(CheckBundle)
+	if err := decode(raw, newBundle); err != nil {
+		return nil, err
+	}
+
+	return newBundle, nil
+}
+
+// UpdateCheckBundle applies changes to an existing check bundle.
+func (a *API) UpdateCheckBundle(bundle *CheckBundle) (*CheckBundle, error) {
+	return a.UpdateCheckBundleContext(context.Background(), bundle)
+}
+
+// UpdateCheckBundleContext applies changes to an existing check bundle,
+// aborting if ctx is done before the call completes.
+func (a *API) UpdateCheckBundleContext(ctx context.Context, bundle *CheckBundle) (*CheckBundle, error) {
+	data, err := json.Marshal(bundle)
+	if err != nil {
+		return nil, fmt.Errorf("unable to encode check bundle: %v", err)
+	}
+
+	raw, err := a.PutContext(ctx, bundle.CID, data)
+	if err != nil {
+		return nil, err
+	}
+
+	updated := new(CheckBundle)
+	if err := decode(raw, updated); err != nil {
+		return nil, err
+	}
+
+	return updated, nil
+}
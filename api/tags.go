@@ -0,0 +1,15 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import "strings"
+
+// TagType is a list of tags in "category:value" form.
+type TagType []string
+
+// String returns the tags joined with commas, for use as a search query value.
+func (t TagType) String() string {
+	return strings.Join(t, ",")
+}
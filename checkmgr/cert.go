@@ -0,0 +1,61 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package checkmgr
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"fmt"
+)
+
+// verifyBrokerCert pins a TLS connection to a broker by confirming the
+// presented certificate's CN (or a SAN DNS name) matches the CN the
+// Circonus API advertises for that broker, and that its public key matches
+// the one pinned for that CN on a previous connection.
+//
+// CN/SAN matching alone isn't enough to guard against a MITM: brokers
+// present certificates signed by Circonus' internal CA rather than a
+// public one, so dial (reverse.go) has to skip Go's chain verification,
+// and without it an attacker able to intercept the connection can mint a
+// self-signed certificate carrying any CN it likes. Pinning the
+// certificate's public key on first contact with a given CN, and requiring
+// every later connection to present the same key, closes that gap for all
+// but the very first connection.
+func verifyBrokerCert(cm *CheckManager, state tls.ConnectionState, expectedCN string) error {
+	if len(state.PeerCertificates) == 0 {
+		return fmt.Errorf("broker presented no certificate")
+	}
+
+	cert := state.PeerCertificates[0]
+	matchesName := cert.Subject.CommonName == expectedCN
+	for _, name := range cert.DNSNames {
+		if name == expectedCN {
+			matchesName = true
+		}
+	}
+	if !matchesName {
+		return fmt.Errorf("broker certificate CN %q does not match expected %q", cert.Subject.CommonName, expectedCN)
+	}
+
+	fingerprint := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+
+	cm.Lock()
+	defer cm.Unlock()
+
+	if cm.brokerCertPins == nil {
+		cm.brokerCertPins = make(map[string][sha256.Size]byte)
+	}
+
+	pinned, ok := cm.brokerCertPins[expectedCN]
+	if !ok {
+		cm.brokerCertPins[expectedCN] = fingerprint
+		return nil
+	}
+	if pinned != fingerprint {
+		return fmt.Errorf("broker %q presented a certificate with an unexpected public key", expectedCN)
+	}
+
+	return nil
+}
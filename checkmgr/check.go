@@ -0,0 +1,800 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package checkmgr resolves, creates and maintains the Circonus check bundle
+// that circonus-gometrics submits metrics to.
+package checkmgr
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/circonus-labs/circonus-gometrics/api"
+)
+
+const (
+	defaultCheckType             = "httptrap"
+	defaultBrokerMaxResponseTime = 500 * time.Millisecond
+
+	// maxBrokerFailoverAttempts bounds how many times initializeTrapURL will
+	// walk the broker list looking for a replacement before giving up,
+	// mirroring the bounded leadership-transfer retry Consul uses when a
+	// raft leader stops responding.
+	maxBrokerFailoverAttempts = 3
+)
+
+// CheckConfig options are used to find, or create, the check bundle that
+// metrics are submitted to.
+type CheckConfig struct {
+	SubmissionURL string
+	ID            string
+	InstanceID    string
+	DisplayName   string
+	Target        string
+	SearchTag     string
+	Secret        string
+	Tags          string
+
+	// StatePath, when set, enables a file-backed CheckStateStore at that
+	// path so the resolved check/bundle/broker survive a process restart
+	// without a fresh search-then-create round trip.
+	StatePath string
+
+	// UseReverse, when true, makes initializeTrapURL also dial the bundle's
+	// mtev_reverse connect URL over TLS and expose that connection through
+	// SubmissionWriter. When it cannot be established, only the HTTP
+	// SubmissionURL is available.
+	UseReverse bool
+
+	// MaxRetries bounds how many times a 429 or 5xx response from the
+	// Circonus API is retried before the error is surfaced to the caller.
+	// Zero uses the api package's default.
+	MaxRetries int
+	// MinRetryWait is the base of the exponential backoff applied between
+	// retries when the API doesn't supply a Retry-After, e.g. "1s". Zero
+	// uses the api package's default.
+	MinRetryWait string
+	// MaxRetryWait caps the backoff between retries, e.g. "30s". Zero uses
+	// the api package's default.
+	MaxRetryWait string
+}
+
+// BrokerConfig options are used to select the broker a new check is placed on.
+type BrokerConfig struct {
+	ID              string
+	SelectTag       string
+	MaxResponseTime string
+}
+
+// Config is passed to New to configure a CheckManager.
+type Config struct {
+	Log    *log.Logger
+	Debug  bool
+	API    api.Config
+	Check  CheckConfig
+	Broker BrokerConfig
+}
+
+// CheckManager resolves (searching, or creating as needed) and maintains the
+// check bundle that metrics are submitted to.
+type CheckManager struct {
+	enabled bool
+	Debug   bool
+	Log     *log.Logger
+
+	apih *api.API
+
+	checkType          string
+	checkID            int
+	checkInstanceID    string
+	checkDisplayName   string
+	checkTarget        string
+	checkSearchTag     api.TagType
+	checkSubmissionURL string
+	checkSecret        string
+
+	brokerSelectTag       api.TagType
+	brokerMaxResponseTime time.Duration
+
+	// searchDeadline/mutateDeadline bound read (search/get) and write
+	// (create/update) API calls respectively, so that a slow read can't
+	// stall a caller (e.g. a Prometheus scrape) indefinitely. Zero means no
+	// deadline is imposed beyond whatever context the caller supplies.
+	searchDeadline time.Duration
+	mutateDeadline time.Duration
+
+	stateStore CheckStateStore
+	useReverse bool
+
+	sync.Mutex
+	checkBundle      *api.CheckBundle
+	trapURL          string
+	reverseConn      *reverseConn
+	brokerCertPins   map[string][sha256.Size]byte
+	metricTags       map[string][]string
+	histograms       map[string]HistogramOptions
+	forceCheckUpdate bool
+}
+
+// New returns a configured CheckManager.
+func New(cfg *Config) (*CheckManager, error) {
+	if cfg == nil {
+		return nil, errors.New("invalid check manager configuration (nil)")
+	}
+
+	cm := &CheckManager{
+		enabled:               true,
+		Debug:                 cfg.Debug,
+		Log:                   cfg.Log,
+		checkType:             defaultCheckType,
+		checkSubmissionURL:    cfg.Check.SubmissionURL,
+		checkInstanceID:       cfg.Check.InstanceID,
+		checkDisplayName:      cfg.Check.DisplayName,
+		checkTarget:           cfg.Check.Target,
+		checkSecret:           cfg.Check.Secret,
+		brokerMaxResponseTime: defaultBrokerMaxResponseTime,
+		metricTags:            make(map[string][]string),
+	}
+
+	if cm.Log == nil {
+		cm.Log = log.New(os.Stderr, "", log.LstdFlags)
+	}
+
+	if cfg.Check.SearchTag != "" {
+		cm.checkSearchTag = api.TagType([]string{cfg.Check.SearchTag})
+	}
+
+	if cfg.Check.StatePath != "" {
+		cm.stateStore = newFileCheckStateStore(cfg.Check.StatePath)
+	}
+
+	cm.useReverse = cfg.Check.UseReverse
+
+	if cfg.Check.ID != "" {
+		id, err := strconv.Atoi(cfg.Check.ID)
+		if err != nil {
+			return nil, fmt.Errorf("invalid check id %q: %v", cfg.Check.ID, err)
+		}
+		cm.checkID = id
+	}
+
+	if cfg.Broker.SelectTag != "" {
+		cm.brokerSelectTag = api.TagType([]string{cfg.Broker.SelectTag})
+	}
+
+	if cfg.Broker.MaxResponseTime != "" {
+		d, err := time.ParseDuration(cfg.Broker.MaxResponseTime)
+		if err != nil {
+			return nil, fmt.Errorf("invalid broker max response time %q: %v", cfg.Broker.MaxResponseTime, err)
+		}
+		cm.brokerMaxResponseTime = d
+	}
+
+	cfg.API.MaxRetries = cfg.Check.MaxRetries
+
+	if cfg.Check.MinRetryWait != "" {
+		d, err := time.ParseDuration(cfg.Check.MinRetryWait)
+		if err != nil {
+			return nil, fmt.Errorf("invalid min retry wait %q: %v", cfg.Check.MinRetryWait, err)
+		}
+		cfg.API.MinRetryWait = d
+	}
+
+	if cfg.Check.MaxRetryWait != "" {
+		d, err := time.ParseDuration(cfg.Check.MaxRetryWait)
+		if err != nil {
+			return nil, fmt.Errorf("invalid max retry wait %q: %v", cfg.Check.MaxRetryWait, err)
+		}
+		cfg.API.MaxRetryWait = d
+	}
+
+	apih, err := api.NewAPI(&cfg.API)
+	if err != nil {
+		return nil, err
+	}
+	cm.apih = apih
+
+	return cm, nil
+}
+
+// logger returns cm.Log, falling back to a discard logger. CheckManager
+// values are normally built via New, which fills in Log, but a value built
+// by hand (e.g. in a test) may leave it nil; this guard keeps that from
+// crashing the process the first time something gets logged.
+func (cm *CheckManager) logger() *log.Logger {
+	if cm.Log == nil {
+		return log.New(ioutil.Discard, "", 0)
+	}
+	return cm.Log
+}
+
+// SetSearchDeadline bounds every read (search/get) API call initializeTrapURL
+// issues. Zero disables the bound, leaving only whatever the caller's
+// context.Context imposes.
+func (cm *CheckManager) SetSearchDeadline(d time.Duration) {
+	cm.searchDeadline = d
+}
+
+// SetMutateDeadline bounds every write (create/update) API call
+// initializeTrapURL and UpdateCheck issue. Zero disables the bound, leaving
+// only whatever the caller's context.Context imposes.
+func (cm *CheckManager) SetMutateDeadline(d time.Duration) {
+	cm.mutateDeadline = d
+}
+
+// searchContext derives a context for a read API call from ctx, applying
+// searchDeadline on top of whatever deadline/cancellation ctx already carries.
+func (cm *CheckManager) searchContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if cm.searchDeadline <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, cm.searchDeadline)
+}
+
+// mutateContext derives a context for a write API call from ctx, applying
+// mutateDeadline on top of whatever deadline/cancellation ctx already carries.
+func (cm *CheckManager) mutateContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if cm.mutateDeadline <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, cm.mutateDeadline)
+}
+
+// initializeTrapURL resolves the submission URL that metrics should be sent
+// to, searching for (or creating) a check bundle as needed.
+func (cm *CheckManager) initializeTrapURL() error {
+	return cm.InitializeTrapURLContext(context.Background())
+}
+
+// InitializeTrapURLContext is the context-aware variant of
+// initializeTrapURL. The supplied ctx governs the overall operation;
+// SetSearchDeadline/SetMutateDeadline further bound the individual read and
+// write API calls it makes along the way.
+func (cm *CheckManager) InitializeTrapURLContext(ctx context.Context) error {
+	if !cm.enabled {
+		return errors.New("unable to initialize trap, check manager is disabled")
+	}
+
+	if cm.trapURL != "" {
+		return nil
+	}
+
+	if cm.checkSubmissionURL != "" {
+		cm.trapURL = cm.checkSubmissionURL
+		cm.checkSubmissionURL = ""
+		return nil
+	}
+
+	if bundle, broker := cm.loadCachedState(ctx); bundle != nil {
+		cm.checkBundle = bundle
+		if err := cm.setTrapURL(bundle, broker); err == nil {
+			if cm.useReverse {
+				if err := cm.initializeReverseConnection(bundle, broker); err != nil {
+					cm.logger().Printf("unable to establish mtev_reverse connection, falling back to HTTP submission: %v", err)
+				}
+			}
+			return nil
+		}
+		cm.logger().Printf("cached check state did not resolve a trap url, re-resolving")
+	}
+
+	var check *api.Check
+	var bundle *api.CheckBundle
+	var broker *api.Broker
+	var err error
+
+	switch {
+	case cm.checkID != 0:
+		bundle, check, broker, err = cm.fetchCheck(ctx, cm.checkID)
+	default:
+		bundle, broker, err = cm.fetchCheckBySearch(ctx)
+		if err == nil && bundle == nil {
+			bundle, broker, err = cm.createNewCheckContext(ctx)
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	cm.checkBundle = bundle
+
+	if err := cm.setTrapURL(bundle, broker); err != nil {
+		return err
+	}
+
+	cm.saveState(check, bundle, broker)
+
+	if cm.useReverse {
+		if err := cm.initializeReverseConnection(bundle, broker); err != nil {
+			cm.logger().Printf("unable to establish mtev_reverse connection, falling back to HTTP submission: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// loadCachedState returns the check bundle and broker from the configured
+// CheckStateStore, provided the cache exists and is still fresh (its
+// LastModified still matches a cheap GET /check_bundle/{id}). A nil bundle
+// means there is no usable cache and the normal search-then-create dance
+// should run.
+func (cm *CheckManager) loadCachedState(ctx context.Context) (*api.CheckBundle, *api.Broker) {
+	if cm.stateStore == nil {
+		return nil, nil
+	}
+
+	state, err := cm.stateStore.Load()
+	if err != nil {
+		cm.logger().Printf("unable to load check state cache, ignoring: %v", err)
+		return nil, nil
+	}
+	if state == nil {
+		return nil, nil
+	}
+
+	sctx, cancel := cm.searchContext(ctx)
+	defer cancel()
+
+	fresh, err := cm.apih.FetchCheckBundleByCIDContext(sctx, state.CheckBundle.CID)
+	if err != nil {
+		cm.logger().Printf("unable to validate check state cache, ignoring: %v", err)
+		return nil, nil
+	}
+	if fresh.LastModified != state.CheckBundle.LastModified {
+		cm.logger().Printf("check state cache is stale, ignoring")
+		return nil, nil
+	}
+
+	bundle := state.CheckBundle
+	broker := state.Broker
+
+	return &bundle, &broker
+}
+
+// saveState persists check (when resolved), bundle, broker and the derived
+// trapURL to the configured CheckStateStore, if any. check is nil when the
+// bundle was resolved by search or creation rather than by numeric check id,
+// since no api.Check is fetched on those paths. Failures are logged rather
+// than surfaced, since the in-memory state is already usable.
+func (cm *CheckManager) saveState(check *api.Check, bundle *api.CheckBundle, broker *api.Broker) {
+	if cm.stateStore == nil {
+		return
+	}
+
+	state := &CheckState{CheckBundle: *bundle, TrapURL: cm.trapURL}
+	if check != nil {
+		state.Check = *check
+	}
+	if broker != nil {
+		state.Broker = *broker
+	}
+
+	if err := cm.stateStore.Save(state); err != nil {
+		cm.logger().Printf("unable to persist check state cache: %v", err)
+	}
+}
+
+// fetchCheck resolves a check, its check bundle, and its broker from a
+// numeric check id.
+func (cm *CheckManager) fetchCheck(ctx context.Context, id int) (*api.CheckBundle, *api.Check, *api.Broker, error) {
+	sctx, cancel := cm.searchContext(ctx)
+	defer cancel()
+
+	check, err := cm.apih.FetchCheckByIDContext(sctx, id)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	bundle, err := cm.apih.FetchCheckBundleByCIDContext(sctx, check.CheckBundleCID)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	broker, err := cm.resolveAndVerifyBroker(ctx, bundle)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return bundle, check, broker, nil
+}
+
+// fetchCheckBySearch looks for an existing check bundle matching the
+// configured target, display name and search tag. A nil bundle (with a nil
+// error) means no match was found.
+func (cm *CheckManager) fetchCheckBySearch(ctx context.Context) (*api.CheckBundle, *api.Broker, error) {
+	criteria := fmt.Sprintf("(active:1)(type:%s)(target:%s)", cm.checkType, cm.checkTarget)
+	if len(cm.checkSearchTag) > 0 {
+		criteria += fmt.Sprintf("(tags:%s)", cm.checkSearchTag.String())
+	}
+
+	sctx, cancel := cm.searchContext(ctx)
+	defer cancel()
+
+	bundles, err := cm.apih.SearchCheckBundlesContext(sctx, criteria)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(bundles) == 0 {
+		return nil, nil, nil
+	}
+
+	bundle := &bundles[0]
+
+	broker, err := cm.resolveAndVerifyBroker(ctx, bundle)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return bundle, broker, nil
+}
+
+func (cm *CheckManager) brokerForBundle(ctx context.Context, bundle *api.CheckBundle) (*api.Broker, error) {
+	if len(bundle.Brokers) == 0 {
+		return nil, errors.New("check bundle has no associated broker")
+	}
+
+	sctx, cancel := cm.searchContext(ctx)
+	defer cancel()
+
+	return cm.apih.FetchBrokerByCIDContext(sctx, bundle.Brokers[0])
+}
+
+// resolveAndVerifyBroker fetches the broker currently assigned to bundle and
+// confirms it is reachable. An unresponsive broker triggers failover to
+// another eligible broker, rebinding bundle to it via a PUT.
+func (cm *CheckManager) resolveAndVerifyBroker(ctx context.Context, bundle *api.CheckBundle) (*api.Broker, error) {
+	broker, err := cm.brokerForBundle(ctx, bundle)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cm.testBroker(broker); err != nil {
+		cm.logger().Printf("broker %s failed reachability test: %v", broker.CID, err)
+		return cm.reselectBroker(ctx, bundle, broker)
+	}
+
+	return broker, nil
+}
+
+// reselectBroker walks the broker list (skipping brokers already ruled out),
+// looking for another broker able to host bundle.Type, and rebinds bundle to
+// the first reachable candidate via PUT /check_bundle/{id}. It gives up,
+// returning a "no viable broker" error, once maxBrokerFailoverAttempts
+// rounds have failed to turn up a working broker.
+func (cm *CheckManager) reselectBroker(ctx context.Context, bundle *api.CheckBundle, failed *api.Broker) (*api.Broker, error) {
+	tried := map[string]bool{failed.CID: true}
+
+	var lastErr error
+
+	for attempt := 1; attempt <= maxBrokerFailoverAttempts; attempt++ {
+		sctx, cancel := cm.searchContext(ctx)
+		brokers, err := cm.apih.FetchBrokersContext(sctx)
+		cancel()
+		if err != nil {
+			lastErr = err
+			cm.logger().Printf("broker failover attempt %d: unable to fetch broker list: %v", attempt, err)
+			continue
+		}
+
+		var candidate *api.Broker
+		for i := range brokers {
+			b := &brokers[i]
+			if tried[b.CID] || !cm.brokerSupportsCheckType(b, bundle.Type) {
+				continue
+			}
+			if err := cm.testBroker(b); err != nil {
+				cm.logger().Printf("broker failover attempt %d: broker %s unreachable: %v", attempt, b.CID, err)
+				tried[b.CID] = true
+				continue
+			}
+			candidate = b
+			break
+		}
+
+		if candidate == nil {
+			lastErr = fmt.Errorf("no eligible broker found")
+			cm.logger().Printf("broker failover attempt %d: %v (last tried broker %s)", attempt, lastErr, failed.CID)
+			continue
+		}
+
+		bundle.Brokers = []string{candidate.CID}
+
+		mctx, mcancel := cm.mutateContext(ctx)
+		updated, err := cm.apih.UpdateCheckBundleContext(mctx, bundle)
+		mcancel()
+		if err != nil {
+			lastErr = err
+			tried[candidate.CID] = true
+			cm.logger().Printf("broker failover attempt %d: unable to rebind check bundle to broker %s: %v", attempt, candidate.CID, err)
+			continue
+		}
+
+		*bundle = *updated
+		cm.logger().Printf("failed over from broker %s to broker %s", failed.CID, candidate.CID)
+
+		return candidate, nil
+	}
+
+	if lastErr == nil {
+		lastErr = errors.New("no eligible broker found")
+	}
+
+	return nil, fmt.Errorf("no viable broker after %d attempts: %v", maxBrokerFailoverAttempts, lastErr)
+}
+
+// setTrapURL derives cm.trapURL from the resolved check bundle. Non-httptrap
+// checks (e.g. json:nad) are pull-based and have no submission URL.
+func (cm *CheckManager) setTrapURL(bundle *api.CheckBundle, broker *api.Broker) error {
+	if bundle.Type != "httptrap" {
+		cm.logger().Printf("check type %q does not accept submissions, not setting trap url", bundle.Type)
+		cm.trapURL = ""
+		return nil
+	}
+
+	if bundle.Config.SubmissionURL == "" {
+		return fmt.Errorf("check bundle %s has no submission url", bundle.CID)
+	}
+
+	cm.trapURL = bundle.Config.SubmissionURL
+
+	return nil
+}
+
+// selectBroker picks a broker able to host a check of the given type, within
+// the configured brokerMaxResponseTime.
+func (cm *CheckManager) selectBroker(ctx context.Context, checkType string) (*api.Broker, error) {
+	sctx, cancel := cm.searchContext(ctx)
+	defer cancel()
+
+	brokers, err := cm.apih.FetchBrokersContext(sctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range brokers {
+		broker := &brokers[i]
+		if !cm.brokerSupportsCheckType(broker, checkType) {
+			continue
+		}
+		if err := cm.testBroker(broker); err != nil {
+			cm.logger().Printf("broker %s failed reachability test: %v", broker.CID, err)
+			continue
+		}
+		return broker, nil
+	}
+
+	return nil, fmt.Errorf("unable to find a broker for check type %q", checkType)
+}
+
+func (cm *CheckManager) brokerSupportsCheckType(broker *api.Broker, checkType string) bool {
+	for _, d := range broker.Details {
+		if d.Status != "active" {
+			continue
+		}
+		for _, m := range d.Modules {
+			if m == checkType {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// testBroker verifies that a broker is reachable within brokerMaxResponseTime.
+func (cm *CheckManager) testBroker(broker *api.Broker) error {
+	if len(broker.Details) == 0 {
+		return errors.New("broker has no details")
+	}
+
+	detail := broker.Details[0]
+
+	host := detail.ExternalHost
+	if host == "" {
+		host = detail.IP
+	}
+	port := detail.ExternalPort
+	if port == 0 {
+		port = detail.Port
+	}
+
+	addr := fmt.Sprintf("%s:%d", host, port)
+
+	conn, err := net.DialTimeout("tcp", addr, cm.brokerMaxResponseTime)
+	if err != nil {
+		return fmt.Errorf("unable to reach broker at %s: %v", addr, err)
+	}
+	conn.Close()
+
+	return nil
+}
+
+// createNewCheck creates a new httptrap check bundle on a viable broker.
+func (cm *CheckManager) createNewCheck() (*api.CheckBundle, *api.Broker, error) {
+	return cm.createNewCheckContext(context.Background())
+}
+
+// CreateNewCheckContext is the context-aware variant of createNewCheck.
+func (cm *CheckManager) CreateNewCheckContext(ctx context.Context) (*api.CheckBundle, *api.Broker, error) {
+	return cm.createNewCheckContext(ctx)
+}
+
+func (cm *CheckManager) createNewCheckContext(ctx context.Context) (*api.CheckBundle, *api.Broker, error) {
+	broker, err := cm.selectBroker(ctx, cm.checkType)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	secret := cm.checkSecret
+	if secret == "" {
+		s, err := cm.makeSecret()
+		if err != nil {
+			return nil, nil, err
+		}
+		secret = s
+	}
+
+	bundle := &api.CheckBundle{
+		Brokers:     []string{broker.CID},
+		DisplayName: cm.checkDisplayName,
+		Config:      api.CheckBundleConfig{ReverseSecret: secret},
+		Metrics:     []api.CheckBundleMetric{},
+		Period:      60,
+		Status:      "active",
+		Target:      cm.checkTarget,
+		Timeout:     10,
+		Type:        cm.checkType,
+		Tags:        cm.checkSearchTag,
+	}
+
+	mctx, cancel := cm.mutateContext(ctx)
+	newBundle, err := cm.apih.NewCheckBundleContext(mctx, bundle)
+	cancel()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cm.checkBundle = newBundle
+
+	return newBundle, broker, nil
+}
+
+// makeSecret generates a random reverse secret for a new check bundle.
+func (cm *CheckManager) makeSecret() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("unable to generate secret: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// UpdateCheck reconciles newMetrics (and any configured metric tags) with the
+// resolved check bundle, issuing a single PUT only when something changed.
+func (cm *CheckManager) UpdateCheck(newMetrics map[string]*api.CheckBundleMetric) {
+	cm.UpdateCheckContext(context.Background(), newMetrics)
+}
+
+// UpdateCheckContext is the context-aware variant of UpdateCheck.
+func (cm *CheckManager) UpdateCheckContext(ctx context.Context, newMetrics map[string]*api.CheckBundleMetric) {
+	if !cm.enabled {
+		return
+	}
+
+	cm.Lock()
+	defer cm.Unlock()
+
+	if cm.checkBundle == nil {
+		if err := cm.InitializeTrapURLContext(ctx); err != nil {
+			cm.logger().Printf("unable to initialize check, not updating: %v", err)
+			return
+		}
+	}
+
+	if cm.checkBundle == nil {
+		return
+	}
+
+	updated := false
+
+	existing := make(map[string]int, len(cm.checkBundle.Metrics))
+	for i, m := range cm.checkBundle.Metrics {
+		existing[m.Name] = i
+	}
+
+	for name, metric := range newMetrics {
+		if idx, found := existing[name]; found {
+			if tags, ok := cm.metricTags[name]; ok && !tagsEqual(cm.checkBundle.Metrics[idx].Tags, tags) {
+				cm.checkBundle.Metrics[idx].Tags = tags
+				updated = true
+			}
+			continue
+		}
+
+		m := *metric
+		if tags, ok := cm.metricTags[name]; ok {
+			m.Tags = tags
+		}
+		cm.checkBundle.Metrics = append(cm.checkBundle.Metrics, m)
+		existing[name] = len(cm.checkBundle.Metrics) - 1
+		updated = true
+	}
+
+	for name, opts := range cm.histograms {
+		layout := opts.layout()
+
+		if idx, found := existing[name]; found {
+			m := &cm.checkBundle.Metrics[idx]
+			if m.Type != "histogram" || m.HistogramLayout != layout {
+				m.Type = "histogram"
+				m.HistogramLayout = layout
+				updated = true
+			}
+			if len(opts.Tags) > 0 && !tagsEqual(m.Tags, opts.Tags) {
+				m.Tags = opts.Tags
+				updated = true
+			}
+			continue
+		}
+
+		cm.checkBundle.Metrics = append(cm.checkBundle.Metrics, api.CheckBundleMetric{
+			Name:            name,
+			Type:            "histogram",
+			Status:          "active",
+			HistogramLayout: layout,
+			Tags:            opts.Tags,
+		})
+		existing[name] = len(cm.checkBundle.Metrics) - 1
+		updated = true
+	}
+
+	for name, tags := range cm.metricTags {
+		idx, found := existing[name]
+		if !found {
+			continue
+		}
+		if !tagsEqual(cm.checkBundle.Metrics[idx].Tags, tags) {
+			cm.checkBundle.Metrics[idx].Tags = tags
+			updated = true
+		}
+	}
+
+	if !updated && !cm.forceCheckUpdate {
+		return
+	}
+
+	mctx, cancel := cm.mutateContext(ctx)
+	newBundle, err := cm.apih.UpdateCheckBundleContext(mctx, cm.checkBundle)
+	cancel()
+	if err != nil {
+		cm.logger().Printf("error updating check bundle: %v", err)
+		return
+	}
+
+	cm.checkBundle = newBundle
+	cm.forceCheckUpdate = false
+}
+
+func tagsEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
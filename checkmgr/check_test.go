@@ -10,12 +10,14 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -83,68 +85,95 @@ var (
 			},
 		},
 	}
+
+	// testBroker2 is a second, independently reachable broker used to
+	// exercise failover when testBroker becomes unresponsive.
+	testBroker2 = api.Broker{
+		CID:  "/broker/5678",
+		Name: "test broker 2",
+		Type: "enterprise",
+		Details: []api.BrokerDetail{
+			api.BrokerDetail{
+				CN:           "testbroker2.example.com",
+				ExternalHost: "",
+				ExternalPort: 43192,
+				IP:           "127.0.0.1",
+				Modules:      []string{"httptrap"},
+				Port:         43192,
+				Status:       "active",
+			},
+		},
+	}
 )
 
 func testCheckServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(testCheckServerHandler))
+}
+
+// testThrottledCheckServer behaves like testCheckServer, except GET
+// /check/1234 returns 429 Too Many Requests for the first throttleCount
+// requests before succeeding, to exercise the retry-with-backoff path.
+func testThrottledCheckServer(throttleCount int32) *httptest.Server {
+	var calls int32
+
 	f := func(w http.ResponseWriter, r *http.Request) {
-		switch r.URL.Path {
-		case "/check_bundle/1234": // handle GET/PUT/DELETE
-			switch r.Method {
-			case "PUT": // update
-				defer r.Body.Close()
-				b, err := ioutil.ReadAll(r.Body)
-				if err != nil {
-					panic(err)
-				}
-				w.WriteHeader(200)
-				w.Header().Set("Content-Type", "application/json")
-				fmt.Fprintln(w, string(b))
-			case "GET": // get by id/cid
-				ret, err := json.Marshal(testCheckBundle)
-				if err != nil {
-					panic(err)
-				}
-				w.WriteHeader(200)
-				w.Header().Set("Content-Type", "application/json")
-				fmt.Fprintln(w, string(ret))
-			default:
-				w.WriteHeader(500)
-				fmt.Fprintln(w, "unsupported method")
+		if r.URL.Path == "/check/1234" && r.Method == "GET" && atomic.AddInt32(&calls, 1) <= throttleCount {
+			w.WriteHeader(http.StatusTooManyRequests)
+			fmt.Fprintln(w, "rate limited")
+			return
+		}
+		testCheckServerHandler(w, r)
+	}
+
+	return httptest.NewServer(http.HandlerFunc(f))
+}
+
+// testCountingCheckServer behaves like testCheckServer, except it also
+// counts PUT /check_bundle/1234 requests, so callers can assert a
+// reconciliation issued exactly one update.
+func testCountingCheckServer() (*httptest.Server, *int32) {
+	var puts int32
+
+	f := func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/check_bundle/1234" && r.Method == "PUT" {
+			atomic.AddInt32(&puts, 1)
+		}
+		testCheckServerHandler(w, r)
+	}
+
+	return httptest.NewServer(http.HandlerFunc(f)), &puts
+}
+
+func testCheckServerHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/check_bundle/1234": // handle GET/PUT/DELETE
+		switch r.Method {
+		case "PUT": // update
+			defer r.Body.Close()
+			b, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				panic(err)
 			}
-		case "/check_bundle":
-			switch r.Method {
-			case "GET": // search
-				if strings.HasPrefix(r.URL.String(), "/check_bundle?search=") {
-					r := []api.CheckBundle{testCheckBundle}
-					ret, err := json.Marshal(r)
-					if err != nil {
-						panic(err)
-					}
-					w.WriteHeader(200)
-					w.Header().Set("Content-Type", "application/json")
-					fmt.Fprintln(w, string(ret))
-				} else {
-					w.WriteHeader(200)
-					w.Header().Set("Content-Type", "application/json")
-					fmt.Fprintln(w, "[]")
-				}
-			case "POST": // create
-				defer r.Body.Close()
-				b, err := ioutil.ReadAll(r.Body)
-				if err != nil {
-					panic(err)
-				}
-				w.WriteHeader(200)
-				w.Header().Set("Content-Type", "application/json")
-				fmt.Fprintln(w, string(b))
-			default:
-				w.WriteHeader(405)
-				fmt.Fprintf(w, "method not allowed %s", r.Method)
+			w.WriteHeader(200)
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintln(w, string(b))
+		case "GET": // get by id/cid
+			ret, err := json.Marshal(testCheckBundle)
+			if err != nil {
+				panic(err)
 			}
-		case "/broker":
-			switch r.Method {
-			case "GET":
-				r := []api.Broker{testBroker}
+			w.WriteHeader(200)
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintln(w, string(ret))
+		default:
+			w.WriteHeader(500)
+			fmt.Fprintln(w, "unsupported method")
+		}
+	case "/check_bundle":
+		switch r.Method {
+		case "GET": // search
+			if strings.HasPrefix(r.URL.String(), "/check_bundle?search=") {
+				r := []api.CheckBundle{testCheckBundle}
 				ret, err := json.Marshal(r)
 				if err != nil {
 					panic(err)
@@ -152,61 +181,101 @@ func testCheckServer() *httptest.Server {
 				w.WriteHeader(200)
 				w.Header().Set("Content-Type", "application/json")
 				fmt.Fprintln(w, string(ret))
-			default:
-				w.WriteHeader(405)
-				fmt.Fprintf(w, "method not allowed %s", r.Method)
-			}
-		case "/broker/1234":
-			switch r.Method {
-			case "GET":
-				ret, err := json.Marshal(testBroker)
-				if err != nil {
-					panic(err)
-				}
+			} else {
 				w.WriteHeader(200)
 				w.Header().Set("Content-Type", "application/json")
-				fmt.Fprintln(w, string(ret))
-			default:
-				w.WriteHeader(405)
-				fmt.Fprintf(w, "method not allowed %s", r.Method)
+				fmt.Fprintln(w, "[]")
 			}
-		case "/check":
-			switch r.Method {
-			case "GET":
-				r := []api.Check{testCheck}
-				ret, err := json.Marshal(r)
-				if err != nil {
-					panic(err)
-				}
-				w.WriteHeader(200)
-				w.Header().Set("Content-Type", "application/json")
-				fmt.Fprintln(w, string(ret))
-			default:
-				w.WriteHeader(405)
-				fmt.Fprintf(w, "method not allowed %s", r.Method)
+		case "POST": // create
+			defer r.Body.Close()
+			b, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				panic(err)
 			}
-		case "/check/1234":
-			switch r.Method {
-			case "GET":
-				ret, err := json.Marshal(testCheck)
-				if err != nil {
-					panic(err)
-				}
-				w.WriteHeader(200)
-				w.Header().Set("Content-Type", "application/json")
-				fmt.Fprintln(w, string(ret))
-			default:
-				w.WriteHeader(405)
-				fmt.Fprintf(w, "method not allowed %s", r.Method)
+			w.WriteHeader(200)
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintln(w, string(b))
+		default:
+			w.WriteHeader(405)
+			fmt.Fprintf(w, "method not allowed %s", r.Method)
+		}
+	case "/broker":
+		switch r.Method {
+		case "GET":
+			r := []api.Broker{testBroker, testBroker2}
+			ret, err := json.Marshal(r)
+			if err != nil {
+				panic(err)
+			}
+			w.WriteHeader(200)
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintln(w, string(ret))
+		default:
+			w.WriteHeader(405)
+			fmt.Fprintf(w, "method not allowed %s", r.Method)
+		}
+	case "/broker/1234":
+		switch r.Method {
+		case "GET":
+			ret, err := json.Marshal(testBroker)
+			if err != nil {
+				panic(err)
+			}
+			w.WriteHeader(200)
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintln(w, string(ret))
+		default:
+			w.WriteHeader(405)
+			fmt.Fprintf(w, "method not allowed %s", r.Method)
+		}
+	case "/broker/5678":
+		switch r.Method {
+		case "GET":
+			ret, err := json.Marshal(testBroker2)
+			if err != nil {
+				panic(err)
+			}
+			w.WriteHeader(200)
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintln(w, string(ret))
+		default:
+			w.WriteHeader(405)
+			fmt.Fprintf(w, "method not allowed %s", r.Method)
+		}
+	case "/check":
+		switch r.Method {
+		case "GET":
+			r := []api.Check{testCheck}
+			ret, err := json.Marshal(r)
+			if err != nil {
+				panic(err)
+			}
+			w.WriteHeader(200)
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintln(w, string(ret))
+		default:
+			w.WriteHeader(405)
+			fmt.Fprintf(w, "method not allowed %s", r.Method)
+		}
+	case "/check/1234":
+		switch r.Method {
+		case "GET":
+			ret, err := json.Marshal(testCheck)
+			if err != nil {
+				panic(err)
 			}
+			w.WriteHeader(200)
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintln(w, string(ret))
 		default:
-			msg := fmt.Sprintf("not found %s", r.URL.Path)
-			w.WriteHeader(404)
-			fmt.Fprintln(w, msg)
+			w.WriteHeader(405)
+			fmt.Fprintf(w, "method not allowed %s", r.Method)
 		}
+	default:
+		msg := fmt.Sprintf("not found %s", r.URL.Path)
+		w.WriteHeader(404)
+		fmt.Fprintln(w, msg)
 	}
-
-	return httptest.NewServer(http.HandlerFunc(f))
 }
 
 func TestUpdateCheck(t *testing.T) {
@@ -277,6 +346,58 @@ func TestUpdateCheck(t *testing.T) {
 
 }
 
+func TestUpdateCheckHistogram(t *testing.T) {
+	server, puts := testCountingCheckServer()
+	defer server.Close()
+
+	ac := &api.Config{
+		TokenApp: "abcd",
+		TokenKey: "1234",
+		URL:      server.URL,
+	}
+	apih, err := api.NewAPI(ac)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	bundle := testCheckBundle
+	bundle.Metrics = append([]api.CheckBundleMetric{}, testCheckBundle.Metrics...)
+
+	cm := &CheckManager{
+		enabled:     true,
+		Log:         log.New(ioutil.Discard, "", 0),
+		apih:        apih,
+		checkBundle: &bundle,
+	}
+
+	cm.RegisterHistogram("latency", HistogramOptions{Buckets: []float64{1, 2, 5, 10}})
+
+	t.Log("new histogram registration")
+	{
+		cm.UpdateCheck(nil)
+		if got := atomic.LoadInt32(puts); got != 1 {
+			t.Fatalf("Expected exactly 1 PUT, got %d", got)
+		}
+	}
+
+	t.Log("no-op reconciliation (layout unchanged)")
+	{
+		cm.UpdateCheck(nil)
+		if got := atomic.LoadInt32(puts); got != 1 {
+			t.Fatalf("Expected no additional PUT, got %d", got)
+		}
+	}
+
+	t.Log("bucket boundaries changed")
+	{
+		cm.RegisterHistogram("latency", HistogramOptions{Buckets: []float64{1, 2, 5, 10, 20}})
+		cm.UpdateCheck(nil)
+		if got := atomic.LoadInt32(puts); got != 2 {
+			t.Fatalf("Expected exactly 1 additional PUT, got %d", got)
+		}
+	}
+}
+
 func TestMakeSecret(t *testing.T) {
 	cm := &CheckManager{}
 
@@ -360,8 +481,7 @@ func TestInitializeTrapURL(t *testing.T) {
 		// Log: log.New(ioutil.Discard, "", log.LstdFlags),
 	}
 
-	t.Log("invalid")
-	{
+	t.Run("invalid", func(t *testing.T) {
 		expectedError := errors.New("unable to initialize trap, check manager is disabled")
 		err := cm.initializeTrapURL()
 		if err == nil {
@@ -370,16 +490,10 @@ func TestInitializeTrapURL(t *testing.T) {
 		if err.Error() != expectedError.Error() {
 			t.Fatalf("Expected %v got '%v'", expectedError, err)
 		}
-	}
+	})
 
 	cm.checkSubmissionURL = "http://127.0.0.1:43191/module/httptrap/abc123-a1b2-c3d4-e5f6-123abc/blah"
-
-	t.Log("cm disabled, only submission URL")
-	{
-		if err := cm.initializeTrapURL(); err != nil {
-			t.Fatalf("Expected no error, got %v", err)
-		}
-	}
+	cm.enabled = true
 
 	ac := &api.Config{
 		TokenApp: "abcd",
@@ -393,28 +507,22 @@ func TestInitializeTrapURL(t *testing.T) {
 		t.Errorf("Expected no error, got '%v'", err)
 	}
 
-	cm.trapURL = ""
-	cm.enabled = true
-
-	t.Log("cm enabled, submission URL")
-	{
-		err := cm.initializeTrapURL()
-		if err != nil {
+	t.Run("cm enabled, only submission URL", func(t *testing.T) {
+		if err := cm.initializeTrapURL(); err != nil {
 			t.Fatalf("Expected no error, got %v", err)
 		}
-	}
+	})
 
 	cm.trapURL = ""
 	cm.checkSubmissionURL = ""
 	cm.checkID = 1234
 
-	t.Log("cm enabled, check id")
-	{
+	t.Run("cm enabled, check id", func(t *testing.T) {
 		err := cm.initializeTrapURL()
 		if err != nil {
 			t.Fatalf("Expected no error, got %v", err)
 		}
-	}
+	})
 
 	cm.trapURL = ""
 	cm.checkSubmissionURL = ""
@@ -424,12 +532,11 @@ func TestInitializeTrapURL(t *testing.T) {
 	cm.checkSearchTag = api.TagType([]string{"cat:tag"})
 	cm.checkDisplayName = "test_dn"
 
-	t.Log("cm enabled, search [found]")
-	{
+	t.Run("cm enabled, search [found]", func(t *testing.T) {
 		if err := cm.initializeTrapURL(); err != nil {
 			t.Fatalf("Expected no error, got %v", err)
 		}
-	}
+	})
 
 	cm.trapURL = ""
 	cm.checkSubmissionURL = ""
@@ -441,13 +548,49 @@ func TestInitializeTrapURL(t *testing.T) {
 	cm.checkType = "httptrap"
 	cm.brokerMaxResponseTime = time.Duration(time.Millisecond * 50)
 
-	t.Log("cm enabled, search [not found, create check]")
-	{
+	t.Run("cm enabled, search [not found, create check]", func(t *testing.T) {
 		err := cm.initializeTrapURL()
 		if err != nil {
 			t.Fatalf("Expected no error, got %v", err)
 		}
+	})
+
+	origExternalHost := testBroker.Details[0].ExternalHost
+	origExternalPort := testBroker.Details[0].ExternalPort
+
+	// Bind and immediately close a listener so the broker's address is
+	// deterministically refused, rather than relying on TEST-NET-1 being an
+	// unroutable black hole -- some sandboxed/proxied environments resolve
+	// and "connect" to it immediately instead of timing out.
+	deadListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
 	}
+	deadAddr := deadListener.Addr().(*net.TCPAddr)
+	deadListener.Close()
+
+	testBroker.Details[0].ExternalHost = deadAddr.IP.String()
+	testBroker.Details[0].ExternalPort = deadAddr.Port
+	testBroker2.Details[0].ExternalHost = hostParts[0]
+	testBroker2.Details[0].ExternalPort = hostPort
+
+	cm.trapURL = ""
+	cm.checkSubmissionURL = ""
+	cm.checkID = 1234
+	cm.checkTarget = ""
+	cm.brokerMaxResponseTime = time.Duration(time.Millisecond * 200)
+
+	t.Run("cm enabled, check id, broker unreachable [failover to next broker]", func(t *testing.T) {
+		if err := cm.initializeTrapURL(); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if cm.checkBundle == nil || len(cm.checkBundle.Brokers) == 0 || cm.checkBundle.Brokers[0] != testBroker2.CID {
+			t.Fatalf("Expected check bundle to be rebound to %s, got %v", testBroker2.CID, cm.checkBundle)
+		}
+	})
+
+	testBroker.Details[0].ExternalHost = origExternalHost
+	testBroker.Details[0].ExternalPort = origExternalPort
 
 	cm.trapURL = ""
 	cm.checkSubmissionURL = ""
@@ -460,12 +603,104 @@ func TestInitializeTrapURL(t *testing.T) {
 
 	testCheckBundle.Type = "json:nad"
 
-	t.Log("cm enabled, id, non-httptrap check")
-	{
+	t.Run("cm enabled, id, non-httptrap check", func(t *testing.T) {
 		err := cm.initializeTrapURL()
 		if err != nil {
 			t.Fatalf("Expected no error, got %v", err)
 		}
+	})
+
+	testCheckBundle.Type = "httptrap"
+
+	stateFile, err := ioutil.TempFile("", "check-state")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
 	}
+	statePath := stateFile.Name()
+	stateFile.Close()
+	defer os.Remove(statePath)
 
+	cm.stateStore = newFileCheckStateStore(statePath)
+	cm.trapURL = ""
+	cm.checkSubmissionURL = ""
+	cm.checkID = 1234
+
+	t.Run("cm enabled, id, cache miss then populate", func(t *testing.T) {
+		if err := cm.initializeTrapURL(); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	})
+
+	cm.trapURL = ""
+
+	t.Run("cm enabled, id, cache hit", func(t *testing.T) {
+		if err := cm.initializeTrapURL(); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	})
+
+	stale := &CheckState{CheckBundle: testCheckBundle}
+	stale.CheckBundle.LastModified = testCheckBundle.LastModified + 1
+	if err := cm.stateStore.Save(stale); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	cm.trapURL = ""
+
+	t.Run("cm enabled, id, stale cache invalidated", func(t *testing.T) {
+		if err := cm.initializeTrapURL(); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	})
+}
+
+func TestInitializeTrapURLRateLimited(t *testing.T) {
+	server := testThrottledCheckServer(3)
+	defer server.Close()
+
+	testURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatalf("Error parsing temporary url %v", err)
+	}
+
+	hostParts := strings.Split(testURL.Host, ":")
+	hostPort, err := strconv.Atoi(hostParts[1])
+	if err != nil {
+		t.Fatalf("Error converting port to numeric %v", err)
+	}
+
+	origExternalHost := testBroker.Details[0].ExternalHost
+	origExternalPort := testBroker.Details[0].ExternalPort
+	testBroker.Details[0].ExternalHost = hostParts[0]
+	testBroker.Details[0].ExternalPort = hostPort
+	defer func() {
+		testBroker.Details[0].ExternalHost = origExternalHost
+		testBroker.Details[0].ExternalPort = origExternalPort
+	}()
+
+	ac := &api.Config{
+		TokenApp:     "abcd",
+		TokenKey:     "1234",
+		URL:          server.URL,
+		MaxRetries:   5,
+		MinRetryWait: time.Millisecond,
+		MaxRetryWait: 10 * time.Millisecond,
+	}
+	apih, err := api.NewAPI(ac)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	cm := &CheckManager{
+		enabled: true,
+		Log:     log.New(ioutil.Discard, "", 0),
+		apih:    apih,
+		checkID: 1234,
+	}
+
+	t.Log("cm enabled, check id, throttled then succeeds")
+	{
+		if err := cm.initializeTrapURL(); err != nil {
+			t.Fatalf("Expected the manager to absorb the transient 429s, got %v", err)
+		}
+	}
 }
@@ -0,0 +1,85 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package checkmgr
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/circonus-labs/circonus-gometrics/api"
+)
+
+// slowCheckServer never responds within the test's deadline, so it stands in
+// for a Circonus API that's stalled or unreachable.
+func slowCheckServer(delay time.Duration) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		w.WriteHeader(200)
+		w.Write([]byte("{}"))
+	}))
+}
+
+func TestInitializeTrapURLContextCancellation(t *testing.T) {
+	server := slowCheckServer(200 * time.Millisecond)
+	defer server.Close()
+
+	ac := &api.Config{TokenApp: "abcd", TokenKey: "1234", URL: server.URL}
+	apih, err := api.NewAPI(ac)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	cm := &CheckManager{
+		enabled:    true,
+		Log:        log.New(ioutil.Discard, "", 0),
+		apih:       apih,
+		checkID:    1234,
+		metricTags: make(map[string][]string),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	if err := cm.InitializeTrapURLContext(ctx); err == nil {
+		t.Fatal("Expected a context deadline error")
+	}
+
+	if cm.checkBundle != nil {
+		t.Fatalf("Expected checkBundle to remain unset, got %+v", cm.checkBundle)
+	}
+}
+
+func TestInitializeTrapURLSearchDeadline(t *testing.T) {
+	server := slowCheckServer(200 * time.Millisecond)
+	defer server.Close()
+
+	ac := &api.Config{TokenApp: "abcd", TokenKey: "1234", URL: server.URL}
+	apih, err := api.NewAPI(ac)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	cm := &CheckManager{
+		enabled:    true,
+		Log:        log.New(ioutil.Discard, "", 0),
+		apih:       apih,
+		checkID:    1234,
+		metricTags: make(map[string][]string),
+	}
+	cm.SetSearchDeadline(20 * time.Millisecond)
+
+	if err := cm.InitializeTrapURLContext(context.Background()); err == nil {
+		t.Fatal("Expected the search deadline to abort the call")
+	}
+
+	if cm.checkBundle != nil {
+		t.Fatalf("Expected checkBundle to remain unset, got %+v", cm.checkBundle)
+	}
+}
@@ -0,0 +1,48 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package checkmgr
+
+import "fmt"
+
+// HistogramOptions configures the bucket layout of a histogram metric
+// registered via RegisterHistogram.
+type HistogramOptions struct {
+	// Buckets sets explicit bucket upper bounds, Prometheus style. Takes
+	// precedence over TicksPerDecade when both are set.
+	Buckets []float64
+
+	// TicksPerDecade selects a log-linear, llhist-compatible bucket layout
+	// with this many buckets per power-of-ten decade, instead of explicit
+	// Buckets.
+	TicksPerDecade int
+
+	// Tags, when non-empty, replace the metric's tags. Tags held for the
+	// same metric name in the CheckManager's metric tags are applied after
+	// these by UpdateCheck and replace them in turn.
+	Tags []string
+}
+
+// layout returns a canonical description of opts' bucket boundaries, used to
+// detect when a histogram's layout has changed and needs to be re-issued.
+func (opts HistogramOptions) layout() string {
+	if len(opts.Buckets) > 0 {
+		return fmt.Sprintf("explicit:%v", opts.Buckets)
+	}
+	return fmt.Sprintf("loglinear:%d", opts.TicksPerDecade)
+}
+
+// RegisterHistogram declares name as a histogram metric with the given
+// bucket layout. The registration is reconciled against the resolved check
+// bundle the next time UpdateCheck runs: the metric is created, or its
+// layout updated, only when the layout has actually changed.
+func (cm *CheckManager) RegisterHistogram(name string, opts HistogramOptions) {
+	cm.Lock()
+	defer cm.Unlock()
+
+	if cm.histograms == nil {
+		cm.histograms = make(map[string]HistogramOptions)
+	}
+	cm.histograms[name] = opts
+}
@@ -0,0 +1,211 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package checkmgr
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/circonus-labs/circonus-gometrics/api"
+)
+
+const (
+	reverseInitialBackoff = 500 * time.Millisecond
+	reverseMaxBackoff     = 30 * time.Second
+	reverseMaxRetries     = 3
+)
+
+// reverseConn is a long-lived mtev_reverse connection to a broker, handed
+// out by SubmissionWriter so a caller can write metric payloads to it instead
+// of POSTing to the check's HTTP submission URL. On a write error it attempts
+// to re-dial and redo the handshake with an exponential backoff, up to
+// reverseMaxRetries times, before giving up and letting the caller fall
+// back to HTTP submission.
+type reverseConn struct {
+	sync.Mutex
+	cm     *CheckManager
+	conn   net.Conn
+	rawURL string
+	secret string
+	cn     string
+}
+
+// initializeReverseConnection establishes the mtev_reverse channel for
+// bundle/broker, when UseReverse is configured and the bundle advertises a
+// reverse connect URL. Failure is logged and returned so the caller can fall
+// back to the already-resolved HTTP submission URL.
+func (cm *CheckManager) initializeReverseConnection(bundle *api.CheckBundle, broker *api.Broker) error {
+	if len(bundle.ReverseConnectURLs) == 0 {
+		return fmt.Errorf("check bundle %s has no reverse connect urls", bundle.CID)
+	}
+
+	cn := ""
+	if len(broker.Details) > 0 {
+		cn = broker.Details[0].CN
+	}
+
+	rc := &reverseConn{
+		cm:     cm,
+		rawURL: bundle.ReverseConnectURLs[0],
+		secret: bundle.Config.ReverseSecret,
+		cn:     cn,
+	}
+
+	conn, err := rc.dial()
+	if err != nil {
+		return err
+	}
+	rc.conn = conn
+
+	cm.Lock()
+	cm.reverseConn = rc
+	cm.Unlock()
+
+	return nil
+}
+
+// SubmissionWriter returns the active mtev_reverse connection as an
+// io.Writer, for a caller (e.g. the top-level gometrics Flush path) that
+// wants to write trap payloads directly to the broker instead of POSTing to
+// TrapURL. It returns nil when UseReverse wasn't configured, or no reverse
+// connection has been established yet -- callers should fall back to an
+// HTTP POST to TrapURL in that case.
+func (cm *CheckManager) SubmissionWriter() io.Writer {
+	cm.Lock()
+	defer cm.Unlock()
+
+	if cm.reverseConn == nil {
+		return nil
+	}
+	return cm.reverseConn
+}
+
+// parseReverseURL splits a "mtev_reverse://host:port/path" connect URL into
+// its host:port and path. net/url.Parse is unusable here: Go's URL scheme
+// grammar forbids underscores, so it rejects the "mtev_reverse" scheme
+// outright.
+func parseReverseURL(rawURL string) (host, path string, err error) {
+	parts := strings.SplitN(rawURL, "://", 2)
+	if len(parts) != 2 || parts[0] != "mtev_reverse" {
+		return "", "", fmt.Errorf("expected an mtev_reverse:// url, got %q", rawURL)
+	}
+
+	hostAndPath := parts[1]
+	if idx := strings.Index(hostAndPath, "/"); idx >= 0 {
+		host = hostAndPath[:idx]
+		path = hostAndPath[idx:]
+	} else {
+		host = hostAndPath
+		path = "/"
+	}
+
+	if host == "" {
+		return "", "", fmt.Errorf("mtev_reverse url %q has no host", rawURL)
+	}
+
+	return host, path, nil
+}
+
+// dial opens a TLS connection to the broker named in rc.rawURL, pins its
+// certificate to rc.cn, and performs the mtev_reverse handshake.
+func (rc *reverseConn) dial() (net.Conn, error) {
+	host, path, err := parseReverseURL(rc.rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid reverse connect url %q: %v", rc.rawURL, err)
+	}
+
+	conn, err := tls.Dial("tcp", host, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		return nil, fmt.Errorf("unable to dial broker at %s: %v", host, err)
+	}
+
+	if rc.cn != "" {
+		if err := verifyBrokerCert(rc.cm, conn.ConnectionState(), rc.cn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	if _, err := fmt.Fprintf(conn, "REVERSE %s\r\nX-Reverse-Secret: %s\r\n\r\n", path, rc.secret); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("unable to send mtev_reverse handshake: %v", err)
+	}
+
+	ack, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("unable to read mtev_reverse handshake ack: %v", err)
+	}
+	if strings.TrimSpace(ack) != "READY" {
+		conn.Close()
+		return nil, fmt.Errorf("broker rejected mtev_reverse handshake: %q", strings.TrimSpace(ack))
+	}
+
+	return conn, nil
+}
+
+// Write sends p over the reverse connection, transparently reconnecting
+// (with exponential backoff) on I/O error before giving up.
+func (rc *reverseConn) Write(p []byte) (int, error) {
+	rc.Lock()
+	defer rc.Unlock()
+
+	backoff := reverseInitialBackoff
+	var lastErr error
+
+	for attempt := 0; attempt <= reverseMaxRetries; attempt++ {
+		if rc.conn != nil {
+			n, err := rc.conn.Write(p)
+			if err == nil {
+				return n, nil
+			}
+			lastErr = err
+			rc.conn.Close()
+			rc.conn = nil
+		}
+
+		if attempt == reverseMaxRetries {
+			break
+		}
+
+		rc.cm.logger().Printf("mtev_reverse write failed, reconnecting (attempt %d): %v", attempt+1, lastErr)
+		time.Sleep(backoff)
+
+		backoff *= 2
+		if backoff > reverseMaxBackoff {
+			backoff = reverseMaxBackoff
+		}
+
+		conn, err := rc.dial()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		rc.conn = conn
+	}
+
+	return 0, fmt.Errorf("mtev_reverse connection unavailable: %v", lastErr)
+}
+
+// Close closes the underlying connection.
+func (rc *reverseConn) Close() error {
+	rc.Lock()
+	defer rc.Unlock()
+
+	if rc.conn == nil {
+		return nil
+	}
+
+	err := rc.conn.Close()
+	rc.conn = nil
+
+	return err
+}
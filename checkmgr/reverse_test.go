@@ -0,0 +1,157 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package checkmgr
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// selfSignedCert returns an ephemeral, throwaway certificate so the fake
+// mtev_reverse server below can speak TLS without touching disk.
+func selfSignedCert(t *testing.T) tls.Certificate {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "testbroker.example.com"},
+		NotBefore:    time.Unix(0, 0),
+		NotAfter:     time.Unix(0, 0).Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// fakeReverseServer speaks just enough of the mtev_reverse handshake for
+// reverseConn.dial to exercise against: it reads the "REVERSE <path>" line
+// and the "X-Reverse-Secret: <secret>" line, then replies READY (if secret
+// matches and accept is true) or DENIED.
+func fakeReverseServer(t *testing.T, secret string, accept bool) (addr string, stop func()) {
+	cert := selfSignedCert(t)
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go handleFakeReverseConn(conn, secret, accept)
+		}
+	}()
+
+	return ln.Addr().String(), func() { ln.Close() }
+}
+
+func handleFakeReverseConn(conn net.Conn, secret string, accept bool) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	reqLine, err := r.ReadString('\n')
+	if err != nil {
+		return
+	}
+	secretLine, err := r.ReadString('\n')
+	if err != nil {
+		return
+	}
+	r.ReadString('\n') // trailing blank line
+
+	wantSecret := fmt.Sprintf("X-Reverse-Secret: %s", secret)
+	ok := accept && strings.HasPrefix(reqLine, "REVERSE ") && strings.TrimSpace(secretLine) == wantSecret
+
+	if !ok {
+		fmt.Fprintf(conn, "DENIED\n")
+		return
+	}
+
+	fmt.Fprintf(conn, "READY\n")
+
+	buf := make([]byte, 256)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	conn.Read(buf)
+}
+
+func TestReverseConnDial(t *testing.T) {
+	addr, stop := fakeReverseServer(t, "blah", true)
+	defer stop()
+
+	rc := &reverseConn{
+		cm:     &CheckManager{Log: log.New(ioutil.Discard, "", 0)},
+		rawURL: fmt.Sprintf("mtev_reverse://%s/check/abc123", addr),
+		secret: "blah",
+	}
+
+	conn, err := rc.dial()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	defer conn.Close()
+}
+
+func TestReverseConnDialRejected(t *testing.T) {
+	addr, stop := fakeReverseServer(t, "blah", false)
+	defer stop()
+
+	rc := &reverseConn{
+		cm:     &CheckManager{Log: log.New(ioutil.Discard, "", 0)},
+		rawURL: fmt.Sprintf("mtev_reverse://%s/check/abc123", addr),
+		secret: "blah",
+	}
+
+	if _, err := rc.dial(); err == nil {
+		t.Fatal("Expected an error for a rejected handshake")
+	}
+}
+
+func TestReverseConnWriteReconnects(t *testing.T) {
+	addr, stop := fakeReverseServer(t, "blah", true)
+	defer stop()
+
+	rc := &reverseConn{
+		cm:     &CheckManager{Log: log.New(ioutil.Discard, "", 0)},
+		rawURL: fmt.Sprintf("mtev_reverse://%s/check/abc123", addr),
+		secret: "blah",
+	}
+
+	conn, err := rc.dial()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	rc.conn = conn
+
+	// Break the live connection out from under rc and confirm Write
+	// transparently re-dials rather than surfacing the stale-conn error.
+	conn.Close()
+
+	if _, err := rc.Write([]byte("test")); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package checkmgr
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/circonus-labs/circonus-gometrics/api"
+)
+
+// CheckState is the resolved check state a CheckStateStore persists between
+// process restarts.
+type CheckState struct {
+	Check       api.Check       `json:"check"`
+	CheckBundle api.CheckBundle `json:"check_bundle"`
+	Broker      api.Broker      `json:"broker"`
+	TrapURL     string          `json:"trap_url"`
+}
+
+// CheckStateStore persists and retrieves a CheckState so that CheckManager
+// does not have to search for (or create) its check bundle on every process
+// restart.
+type CheckStateStore interface {
+	Load() (*CheckState, error)
+	Save(state *CheckState) error
+}
+
+// fileCheckStateStore is the default CheckStateStore, backed by a single
+// JSON file on disk.
+type fileCheckStateStore struct {
+	path string
+}
+
+// newFileCheckStateStore returns a CheckStateStore backed by the file at path.
+func newFileCheckStateStore(path string) *fileCheckStateStore {
+	return &fileCheckStateStore{path: path}
+}
+
+// Load returns the cached state, or (nil, nil) when no cache file exists yet.
+func (s *fileCheckStateStore) Load() (*CheckState, error) {
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("unable to read check state cache %s: %v", s.path, err)
+	}
+
+	state := &CheckState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("corrupt check state cache %s: %v", s.path, err)
+	}
+
+	return state, nil
+}
+
+// Save writes state to the cache file, replacing any previous contents.
+func (s *fileCheckStateStore) Save(state *CheckState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to encode check state cache: %v", err)
+	}
+
+	if err := ioutil.WriteFile(s.path, data, 0600); err != nil {
+		return fmt.Errorf("unable to write check state cache %s: %v", s.path, err)
+	}
+
+	return nil
+}
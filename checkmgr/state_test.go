@@ -0,0 +1,75 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package checkmgr
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/circonus-labs/circonus-gometrics/api"
+)
+
+func TestFileCheckStateStoreSaveLoad(t *testing.T) {
+	f, err := ioutil.TempFile("", "check-state")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	path := f.Name()
+	f.Close()
+	defer os.Remove(path)
+
+	store := newFileCheckStateStore(path)
+
+	want := &CheckState{
+		CheckBundle: api.CheckBundle{CID: "/check_bundle/1234", LastModified: 42},
+		Broker:      api.Broker{CID: "/broker/1234"},
+		TrapURL:     "http://127.0.0.1:43191/module/httptrap/blah",
+	}
+
+	if err := store.Save(want); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	got, err := store.Load()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if got.CheckBundle.CID != want.CheckBundle.CID || got.CheckBundle.LastModified != want.CheckBundle.LastModified {
+		t.Fatalf("Expected %+v, got %+v", want.CheckBundle, got.CheckBundle)
+	}
+}
+
+func TestFileCheckStateStoreMissingFile(t *testing.T) {
+	store := newFileCheckStateStore("/tmp/does-not-exist-check-state-cache.json")
+
+	state, err := store.Load()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if state != nil {
+		t.Fatalf("Expected nil state, got %+v", state)
+	}
+}
+
+func TestFileCheckStateStoreCorruptFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "check-state-corrupt")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	path := f.Name()
+	defer os.Remove(path)
+
+	if _, err := f.WriteString("{not valid json"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	f.Close()
+
+	store := newFileCheckStateStore(path)
+
+	if _, err := store.Load(); err == nil {
+		t.Fatal("Expected an error for a corrupt cache file")
+	}
+}